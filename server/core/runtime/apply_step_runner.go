@@ -0,0 +1,117 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+	"github.com/runatlantis/atlantis/server/core/runtime/tfe"
+	"github.com/runatlantis/atlantis/server/events/command"
+	"github.com/runatlantis/atlantis/server/events/models"
+)
+
+type applyStepRunner struct {
+	TerraformExecutor   TerraformExec
+	DefaultTFVersion    *version.Version
+	CommitStatusUpdater StatusUpdater
+	// TFERunnerFactory constructs the go-tfe-backed runner used to apply a
+	// run that was planned through the native TFC/TFE path. See
+	// planStepRunner.TFERunnerFactory.
+	TFERunnerFactory func(cfg tfe.Config) (*tfe.Runner, error)
+}
+
+func NewApplyStepRunner(terraformExecutor TerraformExec, defaultTfVersion *version.Version, commitStatusUpdater StatusUpdater) Runner {
+	runner := &applyStepRunner{
+		TerraformExecutor:   terraformExecutor,
+		DefaultTFVersion:    defaultTfVersion,
+		CommitStatusUpdater: commitStatusUpdater,
+		TFERunnerFactory:    tfe.NewRunner,
+	}
+	return NewWorkspaceStepRunnerDelegate(terraformExecutor, defaultTfVersion, runner)
+}
+
+func (a *applyStepRunner) Run(ctx *command.ProjectContext, extraArgs []string, path string, envs map[string]string) (string, error) {
+	tfVersion := a.DefaultTFVersion
+	if ctx.TerraformVersion != nil {
+		tfVersion = ctx.TerraformVersion
+	}
+
+	planFile := filepath.Join(path, GetPlanFilename(ctx.Workspace, ctx.ProjectName))
+	contents, err := os.ReadFile(planFile)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read planfile")
+	}
+
+	if runID, _, ok := tfeRunIDFromPlanfile(contents); ok {
+		return a.tfeApply(*ctx, runID)
+	}
+
+	applyCmd := append([]string{"apply", "-no-color"}, extraArgs...)
+	applyCmd = append(applyCmd, ctx.EscapedCommentArgs...)
+	applyCmd = append(applyCmd, planFile)
+	output, err := a.TerraformExecutor.RunCommandWithVersion(*ctx, filepath.Clean(path), applyCmd, envs, tfVersion, ctx.Workspace)
+	return output, err
+}
+
+// tfeRunIDFromPlanfile returns the TFE run ID stored in a planfile written
+// by planStepRunner.tfePlan, if contents is one, along with whether a
+// hard-mandatory policy failed on that run (see tfePlanfileContents).
+func tfeRunIDFromPlanfile(contents []byte) (runID string, hardPolicyFailed bool, ok bool) {
+	if !bytes.HasPrefix(contents, []byte(tfeRunIDHeader)) {
+		return "", false, false
+	}
+	rest := bytes.TrimPrefix(contents, []byte(tfeRunIDHeader))
+	line, rest, _ := bytes.Cut(rest, []byte("\n"))
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return "", false, false
+	}
+	hardPolicyFailed = bytes.Contains(rest, []byte(tfeHardPolicyFailedMarker))
+	return string(line), hardPolicyFailed, true
+}
+
+// tfeApply applies the TFE run that was created by the matching
+// planStepRunner.tfePlan call, rather than diffing the stored plan output
+// against a freshly-run `terraform plan` the way local applies can't (TFC
+// doesn't support `-out`, so there's no local planfile to diff against;
+// the TFE run itself is the source of truth for what will be applied).
+func (a *applyStepRunner) tfeApply(ctx command.ProjectContext, runID string) (string, error) {
+	if ctx.TFEConfig == nil {
+		return "", errors.Errorf("planfile points at TFE run %s but this project is no longer configured with a TFE workspace", runID)
+	}
+
+	runner, err := a.TFERunnerFactory(*ctx.TFEConfig)
+	if err != nil {
+		return "", errors.Wrap(err, "constructing TFE runner")
+	}
+
+	runCtx := ctx.CommandContext
+	if runCtx == nil {
+		runCtx = context.Background()
+	}
+
+	// Check the run's policy check status live, rather than trusting the
+	// hard-failed marker recorded in the planfile at plan time: an
+	// intervening `atlantis policy_override` comment may have cleared it
+	// since then.
+	hardFailed, err := runner.PolicyHardFailed(runCtx, runID)
+	if err != nil {
+		return "", errors.Wrap(err, "checking policy check status")
+	}
+	if hardFailed {
+		return "", errors.Errorf("a hard-mandatory policy failed on TFE run %s; apply is blocked until an `atlantis policy_override` comment is made", runID)
+	}
+
+	run, err := runner.Apply(runCtx, runID)
+	status := models.SuccessCommitStatus
+	if err != nil {
+		status = models.FailedCommitStatus
+	}
+	if statusErr := a.CommitStatusUpdater.UpdateProject(ctx, command.Apply, status, run.URL, nil); statusErr != nil {
+		ctx.Log.Err("unable to update status: %s", statusErr)
+	}
+	return run.Output, err
+}
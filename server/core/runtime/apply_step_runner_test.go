@@ -0,0 +1,168 @@
+package runtime
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	gotfe "github.com/hashicorp/go-tfe"
+	"github.com/runatlantis/atlantis/server/core/runtime/tfe"
+	"github.com/runatlantis/atlantis/server/events/command"
+	"github.com/runatlantis/atlantis/server/events/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStatusUpdater is a no-op StatusUpdater that records its last call,
+// for tests that just need to assert a status was (or wasn't) posted.
+type fakeStatusUpdater struct {
+	lastCmdName command.Name
+	lastStatus  models.CommitStatus
+}
+
+func (f *fakeStatusUpdater) UpdateProject(_ command.ProjectContext, cmdName command.Name, status models.CommitStatus, _ string, _ *int) error {
+	f.lastCmdName = cmdName
+	f.lastStatus = status
+	return nil
+}
+
+// fakeTFEPolicyChecks satisfies just enough of the tfe package's
+// policyChecksClient interface to drive PolicyHardFailed/OverridePolicy
+// in tests.
+type fakeTFEPolicyChecks struct {
+	byID map[string]*gotfe.PolicyCheck
+}
+
+func (f *fakeTFEPolicyChecks) Read(_ context.Context, id string) (*gotfe.PolicyCheck, error) {
+	return f.byID[id], nil
+}
+
+func (f *fakeTFEPolicyChecks) Override(_ context.Context, id string) (*gotfe.PolicyCheck, error) {
+	pc := f.byID[id]
+	pc.Status = gotfe.PolicyOverridden
+	return pc, nil
+}
+
+// fakeTFERunsWithPolicy satisfies just enough of the tfe package's
+// runsClient interface to drive applyStepRunner.tfeApply in tests.
+type fakeTFERunsWithPolicy struct {
+	policyCheckIDs []string
+	applied        bool
+}
+
+func (f *fakeTFERunsWithPolicy) Create(context.Context, gotfe.RunCreateOptions) (*gotfe.Run, error) {
+	return nil, nil
+}
+func (f *fakeTFERunsWithPolicy) Read(context.Context, string) (*gotfe.Run, error) {
+	refs := make([]*gotfe.PolicyCheck, len(f.policyCheckIDs))
+	for i, id := range f.policyCheckIDs {
+		refs[i] = &gotfe.PolicyCheck{ID: id}
+	}
+	return &gotfe.Run{Status: gotfe.RunApplied, Apply: &gotfe.Apply{ID: "apply-1"}, PolicyChecks: refs}, nil
+}
+func (f *fakeTFERunsWithPolicy) Apply(context.Context, string, gotfe.RunApplyOptions) error {
+	f.applied = true
+	return nil
+}
+func (f *fakeTFERunsWithPolicy) Cancel(context.Context, string, gotfe.RunCancelOptions) error {
+	return nil
+}
+func (f *fakeTFERunsWithPolicy) ForceCancel(context.Context, string, gotfe.RunForceCancelOptions) error {
+	return nil
+}
+func (f *fakeTFERunsWithPolicy) Discard(context.Context, string, gotfe.RunDiscardOptions) error {
+	return nil
+}
+
+// fakeTFELogs satisfies the tfe package's logsClient interface with a
+// fixed log output.
+type fakeTFELogs struct{}
+
+func (fakeTFELogs) Logs(context.Context, string) (io.Reader, error) {
+	return strings.NewReader("apply output"), nil
+}
+
+func TestTfeRunIDFromPlanfile(t *testing.T) {
+	cases := []struct {
+		description         string
+		contents            string
+		expRunID            string
+		expHardPolicyFailed bool
+		expOK               bool
+	}{
+		{
+			description: "not a TFE planfile",
+			contents:    "some local plan output\n",
+			expOK:       false,
+		},
+		{
+			description: "TFE planfile with no policy failure",
+			contents:    tfeRunIDHeader + "run-CZcmD7eagjhyX0vN\n",
+			expRunID:    "run-CZcmD7eagjhyX0vN",
+			expOK:       true,
+		},
+		{
+			description:         "TFE planfile with a hard policy failure",
+			contents:            tfeRunIDHeader + "run-CZcmD7eagjhyX0vN\n" + tfeHardPolicyFailedMarker,
+			expRunID:            "run-CZcmD7eagjhyX0vN",
+			expHardPolicyFailed: true,
+			expOK:               true,
+		},
+		{
+			description: "TFE header with no run ID",
+			contents:    tfeRunIDHeader,
+			expOK:       false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.description, func(t *testing.T) {
+			runID, hardPolicyFailed, ok := tfeRunIDFromPlanfile([]byte(c.contents))
+			assert.Equal(t, c.expOK, ok)
+			assert.Equal(t, c.expRunID, runID)
+			assert.Equal(t, c.expHardPolicyFailed, hardPolicyFailed)
+		})
+	}
+}
+
+func TestApplyStepRunner_TfeApply(t *testing.T) {
+	ctx := command.ProjectContext{
+		Log:       noopLogger{},
+		TFEConfig: &tfe.Config{Organization: "my-org", Workspace: "my-workspace"},
+	}
+
+	t.Run("blocked by a live hard-mandatory policy failure", func(t *testing.T) {
+		runs := &fakeTFERunsWithPolicy{policyCheckIDs: []string{"pc-1"}}
+		policyChecks := &fakeTFEPolicyChecks{byID: map[string]*gotfe.PolicyCheck{"pc-1": {ID: "pc-1", Status: gotfe.PolicyFailed}}}
+		statusUpdater := &fakeStatusUpdater{}
+		a := &applyStepRunner{
+			CommitStatusUpdater: statusUpdater,
+			TFERunnerFactory: func(tfe.Config) (*tfe.Runner, error) {
+				return &tfe.Runner{Runs: runs, Applies: fakeTFELogs{}, PolicyChecks: policyChecks}, nil
+			},
+		}
+
+		_, err := a.tfeApply(ctx, "run-123")
+		require.Error(t, err)
+		assert.False(t, runs.applied, "apply should never be called once a hard-mandatory failure is seen")
+	})
+
+	t.Run("applies once the policy check no longer hard-fails", func(t *testing.T) {
+		runs := &fakeTFERunsWithPolicy{policyCheckIDs: []string{"pc-1"}}
+		policyChecks := &fakeTFEPolicyChecks{byID: map[string]*gotfe.PolicyCheck{"pc-1": {ID: "pc-1", Status: gotfe.PolicyOverridden}}}
+		statusUpdater := &fakeStatusUpdater{}
+		a := &applyStepRunner{
+			CommitStatusUpdater: statusUpdater,
+			TFERunnerFactory: func(tfe.Config) (*tfe.Runner, error) {
+				return &tfe.Runner{Runs: runs, Applies: fakeTFELogs{}, PolicyChecks: policyChecks}, nil
+			},
+		}
+
+		output, err := a.tfeApply(ctx, "run-123")
+		require.NoError(t, err)
+		assert.True(t, runs.applied)
+		assert.Equal(t, "apply output", output)
+		assert.Equal(t, models.SuccessCommitStatus, statusUpdater.lastStatus)
+	})
+}
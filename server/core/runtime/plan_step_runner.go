@@ -1,6 +1,8 @@
 package runtime
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -8,7 +10,9 @@ import (
 	"strings"
 
 	version "github.com/hashicorp/go-version"
+	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/pkg/errors"
+	"github.com/runatlantis/atlantis/server/core/runtime/tfe"
 	"github.com/runatlantis/atlantis/server/events/command"
 	"github.com/runatlantis/atlantis/server/events/models"
 )
@@ -17,6 +21,15 @@ const (
 	defaultWorkspace = "default"
 	refreshKeyword   = "Refreshing state..."
 	refreshSeparator = "------------------------------------------------------------------------\n"
+	// tfeRunIDHeader prefixes the planfile we write for a TFE remote run so
+	// that the apply step runner knows this planfile points at a TFE run
+	// rather than a local binary plan, and which run to apply.
+	tfeRunIDHeader = "Atlantis: this plan was created by a TFE remote run\n"
+	// tfeHardPolicyFailedMarker is appended to a TFE planfile when the run
+	// it points at had a hard-mandatory policy failure at plan time. Apply
+	// does not rely on it: it re-reads the run's policy checks live, so an
+	// `atlantis policy_override` comment made since the plan is honored.
+	tfeHardPolicyFailedMarker = "hard_policy_failed\n"
 )
 
 var (
@@ -25,83 +38,347 @@ var (
 	minusDiffRegex = regexp.MustCompile(`(?m)^ {2}-`)
 )
 
+// RunIDTracker records which TFE run ID is currently outstanding for a
+// given project/workspace, so that a later event (the PR closing, a
+// force-push, or a new `atlantis plan`) can find and cancel it instead of
+// leaving it queued against the workspace forever. Keys identify
+// (repo, pull, project, workspace); see runKey. The production
+// implementation, InMemoryRunIDTracker, is a mutex-guarded map of its own
+// and is not backed by the working-dir locker.
+type RunIDTracker interface {
+	TrackRun(key string, runID string)
+	UntrackRun(key string)
+	LookupRun(key string) (string, bool)
+}
+
 type planStepRunner struct {
 	TerraformExecutor   TerraformExec
 	DefaultTFVersion    *version.Version
 	CommitStatusUpdater StatusUpdater
-	AsyncTFExec         AsyncTFExec
+	// TFERunnerFactory constructs the go-tfe-backed runner used for projects
+	// that target a TFC/TFE workspace. It's a factory rather than a single
+	// client because each project may configure a different TFE host/token
+	// via atlantis.yaml.
+	TFERunnerFactory func(cfg tfe.Config) (*tfe.Runner, error)
+	// IgnoreTFEVersionConflict, when set via the server-side
+	// --tfe-ignore-version-conflict flag, downgrades a Terraform version
+	// mismatch against a TFC/TFE workspace from a hard failure to a
+	// warning and proceeds with the workspace's version, mirroring
+	// upstream Terraform's remote backend ignoreVersionConflict behavior
+	// for fleets with mixed TF versions.
+	IgnoreTFEVersionConflict bool
+	// RunIDTracker tracks the outstanding TFE run ID per project/workspace
+	// so it can be canceled if the PR closes, is force-pushed, or a new
+	// plan supersedes it before the run finishes.
+	RunIDTracker RunIDTracker
 }
 
-func NewPlanStepRunner(terraformExecutor TerraformExec, defaultTfVersion *version.Version, commitStatusUpdater StatusUpdater, asyncTFExec AsyncTFExec) Runner {
+func NewPlanStepRunner(terraformExecutor TerraformExec, defaultTfVersion *version.Version, commitStatusUpdater StatusUpdater, ignoreTFEVersionConflict bool, runIDTracker RunIDTracker) Runner {
 	runner := &planStepRunner{
-		TerraformExecutor:   terraformExecutor,
-		DefaultTFVersion:    defaultTfVersion,
-		CommitStatusUpdater: commitStatusUpdater,
-		AsyncTFExec:         asyncTFExec,
+		TerraformExecutor:        terraformExecutor,
+		DefaultTFVersion:         defaultTfVersion,
+		CommitStatusUpdater:      commitStatusUpdater,
+		TFERunnerFactory:         tfe.NewRunner,
+		RunIDTracker:             runIDTracker,
+		IgnoreTFEVersionConflict: ignoreTFEVersionConflict,
 	}
 	return NewWorkspaceStepRunnerDelegate(terraformExecutor, defaultTfVersion, runner)
 }
 
-func (p *planStepRunner) Run(ctx command.ProjectContext, extraArgs []string, path string, envs map[string]string) (string, error) {
+func (p *planStepRunner) Run(ctx *command.ProjectContext, extraArgs []string, path string, envs map[string]string) (string, error) {
 	tfVersion := p.DefaultTFVersion
 	if ctx.TerraformVersion != nil {
 		tfVersion = ctx.TerraformVersion
 	}
 
 	planFile := filepath.Join(path, GetPlanFilename(ctx.Workspace, ctx.ProjectName))
-	planCmd := p.buildPlanCmd(ctx, extraArgs, path, tfVersion, planFile)
-	output, err := p.TerraformExecutor.RunCommandWithVersion(ctx, filepath.Clean(path), planCmd, envs, tfVersion, ctx.Workspace)
-	if p.isRemoteOpsErr(output, err) {
-		ctx.Log.Debug("detected that this project is using TFE remote ops")
-		return p.remotePlan(ctx, extraArgs, path, tfVersion, planFile, envs)
+
+	if ctx.TFEConfig != nil {
+		ctx.Log.Debug("project is configured for native TFE remote operations")
+		reconciled, err := p.reconcileTFEVersion(*ctx, *ctx.TFEConfig, tfVersion)
+		if err != nil {
+			return "", err
+		}
+		return p.tfePlan(*ctx, *ctx.TFEConfig, path, planFile, reconciled)
 	}
+
+	planCmd := p.buildPlanCmd(*ctx, extraArgs, path, tfVersion, planFile)
+	output, err := p.TerraformExecutor.RunCommandWithVersion(*ctx, filepath.Clean(path), planCmd, envs, tfVersion, ctx.Workspace)
 	if err != nil {
 		return output, err
 	}
+
+	// ctx is a pointer here specifically so this assignment is visible to
+	// the caller's ProjectContext, not just this local copy: downstream
+	// consumers (the comment renderer, policy check step, custom workflow
+	// steps) read ctx.PlanJSON after Run returns.
+	ctx.PlanJSON = p.showJSONPlan(*ctx, path, planFile, tfVersion, envs)
+
 	return p.fmtPlanOutput(output, tfVersion), nil
 }
 
-// isRemoteOpsErr returns true if there was an error caused due to this
-// project using TFE remote operations.
-func (p *planStepRunner) isRemoteOpsErr(output string, err error) bool {
-	if err == nil {
-		return false
+// showJSONPlan runs `terraform show -json` against planFile and persists
+// the result next to it as planFile+".json", returning the parsed plan so
+// callers (the comment renderer, policy check step, custom workflow
+// steps) can read per-resource changes without re-parsing the human
+// output. It's best-effort and never fails the plan, since the
+// human-readable output is still the source of truth: if running or
+// parsing `terraform show -json` fails, that is logged and nil is
+// returned; if only persisting the JSON fails, that is logged and the
+// parsed plan is still returned.
+func (p *planStepRunner) showJSONPlan(ctx command.ProjectContext, path string, planFile string, tfVersion *version.Version, envs map[string]string) *tfjson.Plan {
+	minJSONPlanVersion := version.Must(version.NewVersion("0.12.0"))
+	if tfVersion.LessThan(minJSONPlanVersion) {
+		return nil
+	}
+
+	showCmd := []string{"show", "-json", planFile}
+	rawJSON, err := p.TerraformExecutor.RunCommandWithVersion(ctx, filepath.Clean(path), showCmd, envs, tfVersion, ctx.Workspace)
+	if err != nil {
+		ctx.Log.Warn("unable to get json plan output: %s", err)
+		return nil
+	}
+
+	var plan tfjson.Plan
+	if err := json.Unmarshal([]byte(rawJSON), &plan); err != nil {
+		ctx.Log.Warn("unable to parse json plan output: %s", err)
+		return nil
+	}
+
+	if err := os.WriteFile(planJSONFilename(planFile), []byte(rawJSON), 0600); err != nil {
+		ctx.Log.Warn("unable to persist json plan output: %s", err)
 	}
-	return strings.Contains(output, remoteOpsErr110) || strings.Contains(output, remoteOpsErr01114) || strings.Contains(output, remoteOpsErr012) || strings.Contains(output, remoteOpsErr100)
+
+	return &plan
 }
 
-// remotePlan runs a terraform plan command compatible with TFE remote
-// operations.
-func (p *planStepRunner) remotePlan(ctx command.ProjectContext, extraArgs []string, path string, tfVersion *version.Version, planFile string, envs map[string]string) (string, error) {
-	argList := [][]string{
-		{"plan", "-input=false", "-refresh", "-no-color"},
-		extraArgs,
-		ctx.EscapedCommentArgs,
+// planJSONFilename returns the path where the `terraform show -json`
+// output for planFile is persisted.
+func planJSONFilename(planFile string) string {
+	return planFile + ".json"
+}
+
+// tfePlanfileContents builds the contents of the planfile written for a
+// TFE run: a header identifying it as a TFE run, the run ID, and (if the
+// run had a hard-mandatory policy failure) a marker recording that
+// plan-time result. Apply decides whether to block from a live policy
+// check, not from this marker.
+func tfePlanfileContents(runID string, policy *tfe.PolicyCheck) string {
+	contents := tfeRunIDHeader + runID + "\n"
+	if policy != nil && policy.HardFailed {
+		contents += tfeHardPolicyFailedMarker
 	}
-	args := p.flatten(argList)
-	output, err := p.runRemotePlan(ctx, args, path, tfVersion, envs)
+	return contents
+}
+
+// tfePlan runs a plan for a project that's configured to use a TFC/TFE
+// workspace directly through the go-tfe API, rather than shelling out to
+// a local `terraform plan` and scraping its output for remote-ops
+// sentinel strings.
+func (p *planStepRunner) tfePlan(ctx command.ProjectContext, cfg tfe.Config, path string, planFile string, tfVersion *version.Version) (string, error) {
+	runner, err := p.TFERunnerFactory(cfg)
 	if err != nil {
-		return output, err
+		return "", errors.Wrap(err, "constructing TFE runner")
+	}
+
+	// runCtx is canceled when the PR this plan belongs to closes, is
+	// force-pushed, or a newer `atlantis plan` supersedes it. Canceling it
+	// only stops this call waiting on the TFE run; the TFE run itself is
+	// canceled through CancelRun.
+	runCtx := ctx.CommandContext
+	if runCtx == nil {
+		runCtx = context.Background()
 	}
 
-	// If using remote ops, we create our own "fake" planfile with the
-	// text output of the plan. We do this for two reasons:
-	// 1) Atlantis relies on there being a planfile on disk to detect which
-	// projects have outstanding plans.
-	// 2) Remote ops don't support the -out parameter so we can't save the
-	// plan. To ensure that what gets applied is the plan we printed to the PR,
-	// during the apply phase, we diff the output we stored in the fake
-	// planfile with the pending apply output.
-	planOutput := StripRefreshingFromPlanOutput(output, tfVersion)
+	key := runKey(ctx)
 
-	// We also prepend our own remote ops header to the file so during apply we
-	// know this is a remote apply.
-	err = os.WriteFile(planFile, []byte(remoteOpsHeader+planOutput), 0600)
+	// A new plan supersedes any run still outstanding for this
+	// project/workspace (e.g. the previous plan is still running when the
+	// user pushes a new commit and re-triggers `atlantis plan`). Cancel it
+	// first so it doesn't keep holding the workspace after this new run
+	// takes over tracking under the same key.
+	if err := p.CancelRun(runCtx, ctx, cfg); err != nil {
+		ctx.Log.Warn("unable to cancel superseded TFE run: %s", err)
+	}
+
+	onRunURL := func(run tfe.Run) {
+		ctx.Log.Debug("TFE run %s created, updating commit status", run.ID)
+		if p.RunIDTracker != nil {
+			p.RunIDTracker.TrackRun(key, run.ID)
+		}
+		if err := p.CommitStatusUpdater.UpdateProject(ctx, command.Plan, models.PendingCommitStatus, run.URL, nil); err != nil {
+			ctx.Log.Err("unable to update status: %s", err)
+		}
+	}
+
+	run, err := runner.Plan(runCtx, cfg, path, tfVersion.String(), containsDestroy(ctx.EscapedCommentArgs), onRunURL)
+	if p.RunIDTracker != nil && runCtx.Err() == nil {
+		// Only untrack here if the run finished on its own. If runCtx was
+		// canceled, a concurrent CancelRun call is (or will shortly be)
+		// looking up this same key to cancel the underlying TFE run; if
+		// we untrack first it could find nothing and leave that run
+		// queued/running on TFC/TFE forever. CancelRun owns untracking
+		// the key once it's actually handled the cancellation.
+		p.RunIDTracker.UntrackRun(key)
+	}
+	status := models.SuccessCommitStatus
+	if err != nil {
+		status = models.FailedCommitStatus
+	}
+	if statusErr := p.CommitStatusUpdater.UpdateProject(ctx, command.Plan, status, run.URL, nil); statusErr != nil {
+		ctx.Log.Err("unable to update status: %s", statusErr)
+	}
+	p.publishCostAndPolicyStatuses(ctx, run)
 	if err != nil {
-		return output, errors.Wrap(err, "unable to create planfile for remote ops")
+		return run.Output, err
 	}
 
-	return p.fmtPlanOutput(output, tfVersion), nil
+	// We still write a planfile so that Atlantis can detect that this
+	// project/workspace has an outstanding plan, and so that apply knows
+	// which TFE run to apply rather than diffing text output. We write it
+	// even if a hard-mandatory policy failed: apply is what actually
+	// enforces that block (see applyStepRunner.tfeApply), and the user
+	// needs the planfile to exist so a later `atlantis policy_override`
+	// comment has a run to act on.
+	if err := os.WriteFile(planFile, []byte(tfePlanfileContents(run.ID, run.Policy)), 0600); err != nil {
+		return run.Output, errors.Wrap(err, "unable to create planfile for TFE run")
+	}
+
+	summary := p.appendCostAndPolicySummary(run.Output, run)
+	if run.Policy != nil && run.Policy.HardFailed {
+		return summary, errors.Errorf("a hard-mandatory policy failed on TFE run %s; apply is blocked until an `atlantis policy_override` comment is made", run.ID)
+	}
+	return summary, nil
+}
+
+// runKey uniquely identifies a project/workspace within a pull request, so
+// RunIDTracker can look up and cancel an outstanding TFE run in response
+// to a later event for the same PR.
+func runKey(ctx command.ProjectContext) string {
+	return fmt.Sprintf("%s/%d/%s/%s", ctx.BaseRepo.FullName, ctx.Pull.Num, ctx.ProjectName, ctx.Workspace)
+}
+
+// CancelRun cancels the TFE run outstanding for (repo, pull, project,
+// workspace), if any, as tracked by RunIDTracker. It's called by the PR
+// event loop when the pull request is closed, force-pushed, or a new
+// `atlantis plan` is issued for the same project/workspace, so a stale
+// queued or in-progress run doesn't keep holding the workspace after the
+// PR that created it is abandoned.
+func (p *planStepRunner) CancelRun(runCtx context.Context, ctx command.ProjectContext, cfg tfe.Config) error {
+	if p.RunIDTracker == nil {
+		return nil
+	}
+	key := runKey(ctx)
+	runID, ok := p.RunIDTracker.LookupRun(key)
+	if !ok {
+		return nil
+	}
+
+	runner, err := p.TFERunnerFactory(cfg)
+	if err != nil {
+		return errors.Wrap(err, "constructing TFE runner")
+	}
+	if err := runner.Cancel(runCtx, runID); err != nil {
+		return errors.Wrapf(err, "canceling run %s", runID)
+	}
+	p.RunIDTracker.UntrackRun(key)
+	return nil
+}
+
+// publishCostAndPolicyStatuses publishes the TFE run's cost estimate and
+// policy check results as separate commit statuses, if the
+// CommitStatusUpdater supports it and the run produced them. This is
+// best-effort and never fails the plan.
+func (p *planStepRunner) publishCostAndPolicyStatuses(ctx command.ProjectContext, run tfe.Run) {
+	ext, ok := p.CommitStatusUpdater.(ExtendedStatusUpdater)
+	if !ok {
+		return
+	}
+	if run.Cost != nil {
+		if err := ext.UpdateProjectStatus(ctx, "atlantis/plan/cost", models.SuccessCommitStatus, run.Cost.URL); err != nil {
+			ctx.Log.Err("unable to update cost status: %s", err)
+		}
+	}
+	if run.Policy != nil {
+		status := models.SuccessCommitStatus
+		if run.Policy.HardFailed {
+			status = models.FailedCommitStatus
+		}
+		if err := ext.UpdateProjectStatus(ctx, "atlantis/plan/policy", status, run.Policy.URL); err != nil {
+			ctx.Log.Err("unable to update policy status: %s", err)
+		}
+	}
+}
+
+// appendCostAndPolicySummary renders a compact cost estimate and policy
+// check summary and appends it to the plan output shown in the PR
+// comment.
+func (p *planStepRunner) appendCostAndPolicySummary(output string, run tfe.Run) string {
+	var b strings.Builder
+	b.WriteString(output)
+
+	if run.Cost != nil {
+		fmt.Fprintf(&b, "\n\nCost estimate: proposed monthly cost %s (%s)\n", run.Cost.ProposedMonthlyCost, run.Cost.DeltaMonthlyCost)
+	}
+	if run.Policy != nil {
+		fmt.Fprintf(&b, "\nPolicy check: %d passed, %d failed, %d soft-mandatory failed\n", run.Policy.Passed, run.Policy.Failed, run.Policy.SoftFailed)
+		if run.Policy.HardFailed {
+			b.WriteString("A hard-mandatory policy failed. Apply is blocked until an `atlantis policy_override` comment is made.\n")
+		}
+	}
+	return b.String()
+}
+
+// reconcileTFEVersion checks the Terraform version configured on
+// cfg.Workspace in TFC/TFE against tfVersion, the version Atlantis would
+// otherwise use for this project, and returns the version the run should
+// actually be executed with.
+//
+// If they already match, tfVersion is returned unchanged. If they don't,
+// the default is to fail fast with a clear error (surfaced as the PR
+// comment) before a plan is even attempted, since running against the
+// wrong Terraform version can silently produce a materially different
+// plan. Setting the server-side --tfe-ignore-version-conflict flag
+// downgrades that to a warning and proceeds with the workspace's version,
+// which is what TFC/TFE will actually execute regardless (a TFE-backed
+// run never invokes a local terraform binary, so there's nothing to
+// install or reconcile against locally).
+func (p *planStepRunner) reconcileTFEVersion(ctx command.ProjectContext, cfg tfe.Config, tfVersion *version.Version) (*version.Version, error) {
+	runner, err := p.TFERunnerFactory(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "constructing TFE runner")
+	}
+
+	wsVersionStr, err := runner.WorkspaceTerraformVersion(context.Background(), cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading TFE workspace terraform version")
+	}
+	wsVersion, err := version.NewVersion(wsVersionStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing TFE workspace terraform version %q", wsVersionStr)
+	}
+
+	if wsVersion.Equal(tfVersion) {
+		return tfVersion, nil
+	}
+
+	msg := fmt.Sprintf("terraform version mismatch: atlantis is configured to run %s but TFE workspace %s/%s is configured for %s", tfVersion, cfg.Organization, cfg.Workspace, wsVersion)
+	if !p.IgnoreTFEVersionConflict {
+		return nil, errors.New(msg)
+	}
+	ctx.Log.Warn("%s; using workspace version since --tfe-ignore-version-conflict is set", msg)
+	return wsVersion, nil
+}
+
+// containsDestroy returns true if "-destroy" is one of the extra args
+// the user passed in their plan comment.
+func containsDestroy(args []string) bool {
+	for _, a := range args {
+		if a == "-destroy" {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *planStepRunner) buildPlanCmd(ctx command.ProjectContext, extraArgs []string, path string, tfVersion *version.Version, planFile string) []string {
@@ -182,64 +459,6 @@ func (p *planStepRunner) fmtPlanOutput(output string, tfVersion *version.Version
 	return minusDiffRegex.ReplaceAllString(output, "-")
 }
 
-// runRemotePlan runs a terraform command that utilizes the remote operations
-// backend. It watches the command output for the run url to be printed, and
-// then updates the commit status with a link to the run url.
-// The run url is a link to the Terraform Enterprise UI where the output
-// from the in-progress command can be viewed.
-// cmdArgs is the args to terraform to execute.
-// path is the path to where we need to execute.
-func (p *planStepRunner) runRemotePlan(
-	ctx command.ProjectContext,
-	cmdArgs []string,
-	path string,
-	tfVersion *version.Version,
-	envs map[string]string) (string, error) {
-
-	// updateStatusF will update the commit status and log any error.
-	updateStatusF := func(status models.CommitStatus, url string) {
-		if err := p.CommitStatusUpdater.UpdateProject(ctx, command.Plan, status, url, nil); err != nil {
-			ctx.Log.Err("unable to update status: %s", err)
-		}
-	}
-
-	// Start the async command execution.
-	ctx.Log.Debug("starting async tf remote operation")
-	_, outCh := p.AsyncTFExec.RunCommandAsync(ctx, filepath.Clean(path), cmdArgs, envs, tfVersion, ctx.Workspace)
-	var lines []string
-	nextLineIsRunURL := false
-	var runURL string
-	var err error
-
-	for line := range outCh {
-		if line.Err != nil {
-			err = line.Err
-			break
-		}
-		lines = append(lines, line.Line)
-
-		// Here we're checking for the run url and updating the status
-		// if found.
-		if line.Line == lineBeforeRunURL {
-			nextLineIsRunURL = true
-		} else if nextLineIsRunURL {
-			runURL = strings.TrimSpace(line.Line)
-			ctx.Log.Debug("remote run url found, updating commit status")
-			updateStatusF(models.PendingCommitStatus, runURL)
-			nextLineIsRunURL = false
-		}
-	}
-
-	ctx.Log.Debug("async tf remote operation complete")
-	output := strings.Join(lines, "\n")
-	if err != nil {
-		updateStatusF(models.FailedCommitStatus, runURL)
-	} else {
-		updateStatusF(models.SuccessCommitStatus, runURL)
-	}
-	return output, err
-}
-
 func StripRefreshingFromPlanOutput(output string, tfVersion *version.Version) string {
 	if tfVersion.GreaterThanOrEqual(version.Must(version.NewVersion("0.14.0"))) {
 		// Plan output contains a lot of "Refreshing..." lines, remove it
@@ -264,44 +483,3 @@ func StripRefreshingFromPlanOutput(output string, tfVersion *version.Version) st
 	}
 	return output
 }
-
-// remoteOpsErr01114 is the error terraform plan will return if this project is
-// using TFE remote operations in TF 0.11.15.
-var remoteOpsErr01114 = `Error: Saving a generated plan is currently not supported!
-
-The "remote" backend does not support saving the generated execution
-plan locally at this time.
-
-`
-
-// remoteOpsErr012 is the error terraform plan will return if this project is
-// using TFE remote operations in TF 0.12.{0-4}. Later versions haven't been
-// released yet at this time.
-var remoteOpsErr012 = `Error: Saving a generated plan is currently not supported
-
-The "remote" backend does not support saving the generated execution plan
-locally at this time.
-
-`
-
-// remoteOpsErr100 is the error terraform plan will retrun if this project is
-// using TFE remote operations in TF 1.0.{0,1}.
-var remoteOpsErr100 = `Error: Saving a generated plan is currently not supported
-
-The "remote" backend does not support saving the generated execution plan
-locally at this time.
-`
-
-// remoteOpsErr110 is the error terraform plan will return if this project is
-// using Terraform Cloud remote operations in TF 1.1.0 and above
-var remoteOpsErr110 = `╷
-│ Error: Saving a generated plan is currently not supported
-│
-│ Terraform Cloud does not support saving the generated execution plan
-│ locally at this time.
-╵
-`
-
-// remoteOpsHeader is the header we add to the planfile if this plan was
-// generated using TFE remote operations.
-var remoteOpsHeader = "Atlantis: this plan was created by remote ops\n"
@@ -0,0 +1,198 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+
+	gotfe "github.com/hashicorp/go-tfe"
+	version "github.com/hashicorp/go-version"
+	"github.com/runatlantis/atlantis/server/core/runtime/tfe"
+	"github.com/runatlantis/atlantis/server/events/command"
+	"github.com/runatlantis/atlantis/server/events/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// noopLogger is a logging.SimpleLogging that discards everything, for
+// tests that need a non-nil ctx.Log but don't care what it logs.
+type noopLogger struct{}
+
+func (noopLogger) Debug(string, ...interface{}) {}
+func (noopLogger) Info(string, ...interface{})  {}
+func (noopLogger) Warn(string, ...interface{})  {}
+func (noopLogger) Err(string, ...interface{})   {}
+
+// fakeTFEWorkspaces satisfies just enough of the tfe package's
+// workspacesClient interface to drive reconcileTFEVersion in tests.
+type fakeTFEWorkspaces struct {
+	version string
+}
+
+func (f *fakeTFEWorkspaces) Read(context.Context, string, string) (*gotfe.Workspace, error) {
+	return &gotfe.Workspace{TerraformVersion: f.version}, nil
+}
+
+// fakeTFERuns satisfies just enough of the tfe package's runsClient
+// interface to drive CancelRun in tests.
+type fakeTFERuns struct {
+	status    gotfe.RunStatus
+	canceled  bool
+	discarded bool
+}
+
+func (f *fakeTFERuns) Create(context.Context, gotfe.RunCreateOptions) (*gotfe.Run, error) {
+	return nil, nil
+}
+func (f *fakeTFERuns) Read(context.Context, string) (*gotfe.Run, error) {
+	return &gotfe.Run{Status: f.status}, nil
+}
+func (f *fakeTFERuns) Apply(context.Context, string, gotfe.RunApplyOptions) error { return nil }
+func (f *fakeTFERuns) Cancel(context.Context, string, gotfe.RunCancelOptions) error {
+	f.canceled = true
+	return nil
+}
+func (f *fakeTFERuns) ForceCancel(context.Context, string, gotfe.RunForceCancelOptions) error {
+	return nil
+}
+func (f *fakeTFERuns) Discard(context.Context, string, gotfe.RunDiscardOptions) error {
+	f.discarded = true
+	return nil
+}
+
+// fakeRunIDTracker is an in-memory RunIDTracker for tests, distinct from
+// the production InMemoryRunIDTracker so tests don't depend on its
+// internal locking.
+type fakeRunIDTracker struct {
+	runIDs map[string]string
+}
+
+func newFakeRunIDTracker() *fakeRunIDTracker {
+	return &fakeRunIDTracker{runIDs: make(map[string]string)}
+}
+
+func (f *fakeRunIDTracker) TrackRun(key, runID string) { f.runIDs[key] = runID }
+func (f *fakeRunIDTracker) UntrackRun(key string)      { delete(f.runIDs, key) }
+func (f *fakeRunIDTracker) LookupRun(key string) (string, bool) {
+	runID, ok := f.runIDs[key]
+	return runID, ok
+}
+
+func testProjectContext() command.ProjectContext {
+	return command.ProjectContext{
+		Log:         noopLogger{},
+		BaseRepo:    models.Repo{FullName: "runatlantis/atlantis"},
+		Pull:        models.PullRequest{Num: 42},
+		ProjectName: "myproject",
+		Workspace:   "default",
+	}
+}
+
+func TestContainsDestroy(t *testing.T) {
+	assert.True(t, containsDestroy([]string{"-destroy"}))
+	assert.True(t, containsDestroy([]string{"-no-color", "-destroy"}))
+	assert.False(t, containsDestroy([]string{"-no-color"}))
+	assert.False(t, containsDestroy(nil))
+}
+
+func TestTfePlanfileContents(t *testing.T) {
+	cases := []struct {
+		description string
+		policy      *tfe.PolicyCheck
+		exp         string
+	}{
+		{
+			description: "no policy check",
+			policy:      nil,
+			exp:         tfeRunIDHeader + "run-123\n",
+		},
+		{
+			description: "policy check passed",
+			policy:      &tfe.PolicyCheck{HardFailed: false},
+			exp:         tfeRunIDHeader + "run-123\n",
+		},
+		{
+			description: "hard-mandatory policy failed",
+			policy:      &tfe.PolicyCheck{HardFailed: true},
+			exp:         tfeRunIDHeader + "run-123\n" + tfeHardPolicyFailedMarker,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.description, func(t *testing.T) {
+			assert.Equal(t, c.exp, tfePlanfileContents("run-123", c.policy))
+		})
+	}
+}
+
+func TestRunKey(t *testing.T) {
+	ctx := command.ProjectContext{
+		BaseRepo:    models.Repo{FullName: "runatlantis/atlantis"},
+		Pull:        models.PullRequest{Num: 42},
+		ProjectName: "myproject",
+		Workspace:   "default",
+	}
+	assert.Equal(t, "runatlantis/atlantis/42/myproject/default", runKey(ctx))
+}
+
+func tfeRunnerFactory(workspaceVersion string, runs *fakeTFERuns) func(tfe.Config) (*tfe.Runner, error) {
+	return func(tfe.Config) (*tfe.Runner, error) {
+		return &tfe.Runner{
+			Workspaces: &fakeTFEWorkspaces{version: workspaceVersion},
+			Runs:       runs,
+		}, nil
+	}
+}
+
+func TestPlanStepRunner_ReconcileTFEVersion(t *testing.T) {
+	cfg := tfe.Config{Organization: "my-org", Workspace: "my-workspace"}
+	tfVersion := version.Must(version.NewVersion("1.5.0"))
+
+	t.Run("versions match", func(t *testing.T) {
+		p := &planStepRunner{TFERunnerFactory: tfeRunnerFactory("1.5.0", &fakeTFERuns{})}
+		got, err := p.reconcileTFEVersion(testProjectContext(), cfg, tfVersion)
+		require.NoError(t, err)
+		assert.Equal(t, tfVersion, got)
+	})
+
+	t.Run("mismatch fails fast by default", func(t *testing.T) {
+		p := &planStepRunner{TFERunnerFactory: tfeRunnerFactory("1.4.0", &fakeTFERuns{})}
+		_, err := p.reconcileTFEVersion(testProjectContext(), cfg, tfVersion)
+		require.Error(t, err)
+	})
+
+	t.Run("mismatch warns and uses workspace version when ignored", func(t *testing.T) {
+		p := &planStepRunner{
+			TFERunnerFactory:         tfeRunnerFactory("1.4.0", &fakeTFERuns{}),
+			IgnoreTFEVersionConflict: true,
+		}
+		got, err := p.reconcileTFEVersion(testProjectContext(), cfg, tfVersion)
+		require.NoError(t, err)
+		assert.Equal(t, "1.4.0", got.String())
+	})
+}
+
+func TestPlanStepRunner_CancelRun(t *testing.T) {
+	ctx := testProjectContext()
+	cfg := tfe.Config{Organization: "my-org", Workspace: "my-workspace"}
+	key := runKey(ctx)
+
+	t.Run("no tracked run is a no-op", func(t *testing.T) {
+		runs := &fakeTFERuns{status: gotfe.RunPlanning}
+		p := &planStepRunner{TFERunnerFactory: tfeRunnerFactory("1.5.0", runs), RunIDTracker: newFakeRunIDTracker()}
+		require.NoError(t, p.CancelRun(context.Background(), ctx, cfg))
+		assert.False(t, runs.canceled)
+		assert.False(t, runs.discarded)
+	})
+
+	t.Run("tracked run is canceled and untracked", func(t *testing.T) {
+		tracker := newFakeRunIDTracker()
+		tracker.TrackRun(key, "run-123")
+		runs := &fakeTFERuns{status: gotfe.RunPlanning}
+		p := &planStepRunner{TFERunnerFactory: tfeRunnerFactory("1.5.0", runs), RunIDTracker: tracker}
+
+		require.NoError(t, p.CancelRun(context.Background(), ctx, cfg))
+		assert.True(t, runs.canceled)
+		_, ok := tracker.LookupRun(key)
+		assert.False(t, ok, "CancelRun should untrack the run once canceled")
+	})
+}
@@ -0,0 +1,72 @@
+package runtime
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/runatlantis/atlantis/server/core/runtime/tfe"
+	"github.com/runatlantis/atlantis/server/events/command"
+	"github.com/runatlantis/atlantis/server/events/models"
+)
+
+// policyOverrideStepRunner handles an `atlantis policy_override` comment:
+// it overrides a hard-mandatory policy check failure on the TFE run a
+// prior plan created for this project/workspace, so apply is no longer
+// blocked. Unlike plan/apply, this step doesn't run Terraform at all; it
+// just calls through to the TFC/TFE API for the outstanding run.
+type policyOverrideStepRunner struct {
+	CommitStatusUpdater StatusUpdater
+	// TFERunnerFactory constructs the go-tfe-backed runner used to
+	// override the policy check. See planStepRunner.TFERunnerFactory.
+	TFERunnerFactory func(cfg tfe.Config) (*tfe.Runner, error)
+}
+
+// NewPolicyOverrideStepRunner constructs the Runner invoked for an
+// `atlantis policy_override` comment.
+func NewPolicyOverrideStepRunner(commitStatusUpdater StatusUpdater) Runner {
+	return &policyOverrideStepRunner{
+		CommitStatusUpdater: commitStatusUpdater,
+		TFERunnerFactory:    tfe.NewRunner,
+	}
+}
+
+func (p *policyOverrideStepRunner) Run(ctx *command.ProjectContext, extraArgs []string, path string, envs map[string]string) (string, error) {
+	if ctx.TFEConfig == nil {
+		return "", errors.New("policy_override is only supported for projects configured with a TFE workspace")
+	}
+
+	planFile := filepath.Join(path, GetPlanFilename(ctx.Workspace, ctx.ProjectName))
+	contents, err := os.ReadFile(planFile)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read planfile")
+	}
+	runID, _, ok := tfeRunIDFromPlanfile(contents)
+	if !ok {
+		return "", errors.New("no outstanding TFE run found for this project/workspace to override")
+	}
+
+	runner, err := p.TFERunnerFactory(*ctx.TFEConfig)
+	if err != nil {
+		return "", errors.Wrap(err, "constructing TFE runner")
+	}
+
+	runCtx := ctx.CommandContext
+	if runCtx == nil {
+		runCtx = context.Background()
+	}
+
+	err = runner.OverridePolicy(runCtx, runID)
+	status := models.SuccessCommitStatus
+	if err != nil {
+		status = models.FailedCommitStatus
+	}
+	if statusErr := p.CommitStatusUpdater.UpdateProject(*ctx, command.PolicyOverride, status, "", nil); statusErr != nil {
+		ctx.Log.Err("unable to update status: %s", statusErr)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "overriding policy for run %s", runID)
+	}
+	return "Policy check overridden. Run `atlantis apply` to apply.", nil
+}
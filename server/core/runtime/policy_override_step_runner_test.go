@@ -0,0 +1,55 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	gotfe "github.com/hashicorp/go-tfe"
+	"github.com/runatlantis/atlantis/server/core/runtime/tfe"
+	"github.com/runatlantis/atlantis/server/events/command"
+	"github.com/runatlantis/atlantis/server/events/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyOverrideStepRunner_Run(t *testing.T) {
+	dir := t.TempDir()
+	ctx := &command.ProjectContext{
+		Log:       noopLogger{},
+		Workspace: "default",
+		TFEConfig: &tfe.Config{Organization: "my-org", Workspace: "my-workspace"},
+	}
+	planFile := filepath.Join(dir, GetPlanFilename(ctx.Workspace, ctx.ProjectName))
+	require.NoError(t, os.WriteFile(planFile, []byte(tfePlanfileContents("run-123", &tfe.PolicyCheck{HardFailed: true})), 0600))
+
+	runs := &fakeTFERunsWithPolicy{policyCheckIDs: []string{"pc-1"}}
+	policyChecks := &fakeTFEPolicyChecks{byID: map[string]*gotfe.PolicyCheck{"pc-1": {ID: "pc-1", Status: gotfe.PolicyFailed}}}
+	statusUpdater := &fakeStatusUpdater{}
+	p := &policyOverrideStepRunner{
+		CommitStatusUpdater: statusUpdater,
+		TFERunnerFactory: func(tfe.Config) (*tfe.Runner, error) {
+			return &tfe.Runner{Runs: runs, PolicyChecks: policyChecks}, nil
+		},
+	}
+
+	_, err := p.Run(ctx, nil, dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, gotfe.PolicyOverridden, policyChecks.byID["pc-1"].Status)
+	assert.Equal(t, command.PolicyOverride, statusUpdater.lastCmdName)
+	assert.Equal(t, models.SuccessCommitStatus, statusUpdater.lastStatus)
+}
+
+func TestPolicyOverrideStepRunner_Run_NoOutstandingRun(t *testing.T) {
+	dir := t.TempDir()
+	ctx := &command.ProjectContext{
+		Log:       noopLogger{},
+		Workspace: "default",
+		TFEConfig: &tfe.Config{},
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, GetPlanFilename(ctx.Workspace, ctx.ProjectName)), []byte("local plan, not a TFE run\n"), 0600))
+
+	p := &policyOverrideStepRunner{CommitStatusUpdater: &fakeStatusUpdater{}}
+	_, err := p.Run(ctx, nil, dir, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,176 @@
+// Package runtime implements the individual steps (init/plan/apply/...) of
+// an Atlantis workflow for a single project.
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+	"github.com/runatlantis/atlantis/server/core/runtime/tfe"
+	"github.com/runatlantis/atlantis/server/events/command"
+	"github.com/runatlantis/atlantis/server/events/models"
+	"github.com/runatlantis/atlantis/server/logging"
+)
+
+// Runner runs a single workflow step (e.g. plan, apply) for a project and
+// returns the output to post back as a PR comment.
+//
+// ctx is passed by pointer, rather than by value, so a step can feed
+// information back to the caller's ProjectContext (e.g. the plan step
+// setting PlanJSON) by assigning through it, instead of that assignment
+// only ever mutating a copy that's discarded when Run returns.
+type Runner interface {
+	Run(ctx *command.ProjectContext, extraArgs []string, path string, envs map[string]string) (string, error)
+}
+
+// TerraformExec runs the local `terraform` binary. It's implemented by the
+// project's terraform.Client.
+type TerraformExec interface {
+	RunCommandWithVersion(ctx command.ProjectContext, path string, args []string, envs map[string]string, v *version.Version, workspace string) (string, error)
+	EnsureVersion(log logging.SimpleLogging, v *version.Version) error
+}
+
+// StatusUpdater posts a commit status describing the outcome of a
+// project's plan/apply step to the underlying VCS host.
+type StatusUpdater interface {
+	UpdateProject(ctx command.ProjectContext, cmdName command.Name, status models.CommitStatus, url string, numResources *int) error
+}
+
+// ExtendedStatusUpdater is satisfied by a StatusUpdater that also supports
+// posting a commit status under an arbitrary status name, rather than the
+// fixed set tied to command.Name. It's used to publish the
+// "atlantis/plan/cost" and "atlantis/plan/policy" statuses for TFE runs
+// alongside the regular "atlantis/plan" status.
+type ExtendedStatusUpdater interface {
+	StatusUpdater
+	UpdateProjectStatus(ctx command.ProjectContext, statusName string, status models.CommitStatus, url string) error
+}
+
+// RunCanceler is satisfied by a Runner that can cancel an outstanding TFE
+// run for a project/workspace. It's implemented by planStepRunner and
+// forwarded by WorkspaceStepRunnerDelegate, and is type-asserted from a
+// Runner rather than added to the Runner interface itself since only
+// TFE-backed plan runners support it.
+type RunCanceler interface {
+	CancelRun(runCtx context.Context, ctx command.ProjectContext, cfg tfe.Config) error
+}
+
+// VCSStatusPoster is satisfied by the client that actually talks to the
+// VCS host (GitHub, GitLab, etc.) to set a commit status under an
+// arbitrary status name/context.
+type VCSStatusPoster interface {
+	UpdateStatus(repo models.Repo, pull models.PullRequest, status models.CommitStatus, statusName string, description string, url string) error
+}
+
+// DefaultStatusUpdater is the production StatusUpdater. It also implements
+// ExtendedStatusUpdater, since TFE runs need to post statuses under status
+// names that don't correspond to a command.Name.
+type DefaultStatusUpdater struct {
+	VCSClient VCSStatusPoster
+}
+
+// UpdateProject posts the standard "atlantis/<command>[: <project>]"
+// commit status.
+func (d *DefaultStatusUpdater) UpdateProject(ctx command.ProjectContext, cmdName command.Name, status models.CommitStatus, url string, numResources *int) error {
+	statusName := fmt.Sprintf("atlantis/%s", cmdName.String())
+	if ctx.ProjectName != "" {
+		statusName = fmt.Sprintf("%s: %s", statusName, ctx.ProjectName)
+	}
+	return d.UpdateProjectStatus(ctx, statusName, status, url)
+}
+
+// UpdateProjectStatus posts a commit status under an arbitrary
+// statusName, bypassing the "atlantis/<command>" naming UpdateProject
+// uses.
+func (d *DefaultStatusUpdater) UpdateProjectStatus(ctx command.ProjectContext, statusName string, status models.CommitStatus, url string) error {
+	return d.VCSClient.UpdateStatus(ctx.BaseRepo, ctx.Pull, status, statusName, "", url)
+}
+
+// GetPlanFilename returns the name of the planfile Atlantis persists for a
+// given project/workspace, relative to the project's directory.
+func GetPlanFilename(workspace string, projectName string) string {
+	if projectName == "" {
+		return fmt.Sprintf("%s.tfplan", workspace)
+	}
+	return fmt.Sprintf("%s-%s.tfplan", workspace, projectName)
+}
+
+// WorkspaceStepRunnerDelegate wraps a Runner, ensuring the project's
+// Terraform version is available locally before delegating to it. TFE-
+// backed projects skip that check since Terraform never runs locally for
+// them.
+type WorkspaceStepRunnerDelegate struct {
+	TerraformExecutor TerraformExec
+	DefaultTFVersion  *version.Version
+	Delegate          Runner
+}
+
+// NewWorkspaceStepRunnerDelegate wraps delegate so that, for local runs, the
+// project's configured Terraform version is installed before delegate runs.
+func NewWorkspaceStepRunnerDelegate(terraformExecutor TerraformExec, defaultTfVersion *version.Version, delegate Runner) Runner {
+	return &WorkspaceStepRunnerDelegate{
+		TerraformExecutor: terraformExecutor,
+		DefaultTFVersion:  defaultTfVersion,
+		Delegate:          delegate,
+	}
+}
+
+func (w *WorkspaceStepRunnerDelegate) Run(ctx *command.ProjectContext, extraArgs []string, path string, envs map[string]string) (string, error) {
+	if ctx.TFEConfig == nil {
+		tfVersion := w.DefaultTFVersion
+		if ctx.TerraformVersion != nil {
+			tfVersion = ctx.TerraformVersion
+		}
+		if err := w.TerraformExecutor.EnsureVersion(ctx.Log, tfVersion); err != nil {
+			return "", errors.Wrapf(err, "ensuring terraform version %s is available", tfVersion)
+		}
+	}
+	return w.Delegate.Run(ctx, extraArgs, path, envs)
+}
+
+// CancelRun forwards to the wrapped Delegate's CancelRun, if it supports
+// RunCanceler, so callers driving PR-close/force-push/supersede events
+// only need to hold the Runner returned by NewPlanStepRunner, not the
+// unexported planStepRunner underneath it.
+func (w *WorkspaceStepRunnerDelegate) CancelRun(runCtx context.Context, ctx command.ProjectContext, cfg tfe.Config) error {
+	canceler, ok := w.Delegate.(RunCanceler)
+	if !ok {
+		return nil
+	}
+	return canceler.CancelRun(runCtx, ctx, cfg)
+}
+
+// InMemoryRunIDTracker is the production RunIDTracker. It's safe for
+// concurrent use since TrackRun/UntrackRun/LookupRun are all called from
+// the PR event-handling goroutines without any other synchronization.
+type InMemoryRunIDTracker struct {
+	mu     sync.Mutex
+	runIDs map[string]string
+}
+
+// NewInMemoryRunIDTracker constructs an empty InMemoryRunIDTracker.
+func NewInMemoryRunIDTracker() *InMemoryRunIDTracker {
+	return &InMemoryRunIDTracker{runIDs: make(map[string]string)}
+}
+
+func (t *InMemoryRunIDTracker) TrackRun(key string, runID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.runIDs[key] = runID
+}
+
+func (t *InMemoryRunIDTracker) UntrackRun(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.runIDs, key)
+}
+
+func (t *InMemoryRunIDTracker) LookupRun(key string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	runID, ok := t.runIDs[key]
+	return runID, ok
+}
@@ -0,0 +1,503 @@
+// Package tfe implements a native Terraform Cloud/Enterprise runner that
+// drives remote runs through the go-tfe API. It replaces the older
+// approach of scraping `terraform plan`/`terraform apply` stdout for
+// magic strings (the "remote ops" error variants and a run-URL marker
+// line) to detect and follow a remote run.
+package tfe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	gotfe "github.com/hashicorp/go-tfe"
+	"github.com/pkg/errors"
+)
+
+// pollInterval is how often we re-read a Run while waiting for it to
+// reach a terminal status.
+const pollInterval = 2 * time.Second
+
+// Config identifies the TFC/TFE workspace a project should run against.
+// It's sourced per-repo from the project's atlantis.yaml.
+type Config struct {
+	// Hostname is the TFC/TFE hostname, e.g. "app.terraform.io".
+	Hostname string
+	// Organization is the TFC/TFE organization name.
+	Organization string
+	// Workspace is the TFC/TFE workspace name.
+	Workspace string
+	// Token is the API token used to authenticate to Hostname.
+	Token string
+}
+
+// Run is the result of driving a plan or apply through go-tfe.
+type Run struct {
+	// ID is the TFC/TFE run ID, e.g. "run-CZcmD7eagjhyX0vN".
+	ID string
+	// URL is a link to the run in the TFC/TFE UI.
+	URL string
+	// Output is the combined plan or apply log output.
+	Output string
+	// Cost is the run's cost estimate, if TFC/TFE cost estimation is
+	// enabled on the workspace. Nil otherwise.
+	Cost *CostEstimate
+	// Policy is the run's policy check result, if the workspace has a
+	// Sentinel or OPA policy set attached. Nil otherwise.
+	Policy *PolicyCheck
+}
+
+// CostEstimate summarizes a TFC/TFE run's cost estimate.
+type CostEstimate struct {
+	// ProposedMonthlyCost is the estimated total monthly cost after the
+	// plan is applied, as a decimal string, e.g. "128.40".
+	ProposedMonthlyCost string
+	// DeltaMonthlyCost is the estimated change in monthly cost this plan
+	// would cause, as a decimal string, e.g. "+12.50".
+	DeltaMonthlyCost string
+	// URL links to the cost estimate in the TFC/TFE UI.
+	URL string
+}
+
+// PolicyCheck summarizes a TFC/TFE run's Sentinel/OPA policy check
+// result.
+type PolicyCheck struct {
+	// Status is the raw go-tfe policy check status, e.g. "passed",
+	// "failed", "soft_failed".
+	Status string
+	// Passed, Failed and SoftFailed are the policy counts reported for
+	// the check.
+	Passed, Failed, SoftFailed int
+	// HardFailed is true if at least one hard-mandatory policy failed,
+	// which blocks apply.
+	HardFailed bool
+	// URL links to the policy check in the TFC/TFE UI.
+	URL string
+}
+
+// workspacesClient is the subset of go-tfe's Workspaces service Runner
+// uses. It's declared locally, rather than reusing gotfe.Workspaces
+// directly, so tests can supply a minimal fake without having to
+// implement that service's full (and larger) interface.
+type workspacesClient interface {
+	Read(ctx context.Context, organization, workspace string) (*gotfe.Workspace, error)
+}
+
+// configurationVersionsClient is the subset of go-tfe's
+// ConfigurationVersions service Runner uses.
+type configurationVersionsClient interface {
+	Create(ctx context.Context, workspaceID string, options gotfe.ConfigurationVersionCreateOptions) (*gotfe.ConfigurationVersion, error)
+	Upload(ctx context.Context, uploadURL string, path string) error
+}
+
+// runsClient is the subset of go-tfe's Runs service Runner uses.
+type runsClient interface {
+	Create(ctx context.Context, options gotfe.RunCreateOptions) (*gotfe.Run, error)
+	Read(ctx context.Context, runID string) (*gotfe.Run, error)
+	Apply(ctx context.Context, runID string, options gotfe.RunApplyOptions) error
+	Cancel(ctx context.Context, runID string, options gotfe.RunCancelOptions) error
+	ForceCancel(ctx context.Context, runID string, options gotfe.RunForceCancelOptions) error
+	Discard(ctx context.Context, runID string, options gotfe.RunDiscardOptions) error
+}
+
+// logsClient is satisfied by both go-tfe's Plans and Applies services,
+// which Runner only ever uses to fetch a run's plan/apply log.
+type logsClient interface {
+	Logs(ctx context.Context, id string) (io.Reader, error)
+}
+
+// costEstimatesClient is the subset of go-tfe's CostEstimates service
+// Runner uses.
+type costEstimatesClient interface {
+	Read(ctx context.Context, costEstimateID string) (*gotfe.CostEstimate, error)
+}
+
+// policyChecksClient is the subset of go-tfe's PolicyChecks service
+// Runner uses.
+type policyChecksClient interface {
+	Read(ctx context.Context, policyCheckID string) (*gotfe.PolicyCheck, error)
+	Override(ctx context.Context, policyCheckID string) (*gotfe.PolicyCheck, error)
+}
+
+// Runner drives a Terraform Cloud/Enterprise run for a single project
+// using the go-tfe API instead of scraping terraform's stdout.
+type Runner struct {
+	Workspaces            workspacesClient
+	ConfigurationVersions configurationVersionsClient
+	Runs                  runsClient
+	Plans                 logsClient
+	Applies               logsClient
+	CostEstimates         costEstimatesClient
+	PolicyChecks          policyChecksClient
+}
+
+// NewRunner constructs a Runner talking to the TFC/TFE instance described
+// by cfg.
+func NewRunner(cfg Config) (*Runner, error) {
+	client, err := gotfe.NewClient(&gotfe.Config{
+		Address: fmt.Sprintf("https://%s", cfg.Hostname),
+		Token:   cfg.Token,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating go-tfe client")
+	}
+	return &Runner{
+		Workspaces:            client.Workspaces,
+		ConfigurationVersions: client.ConfigurationVersions,
+		Runs:                  client.Runs,
+		Plans:                 client.Plans,
+		Applies:               client.Applies,
+		CostEstimates:         client.CostEstimates,
+		PolicyChecks:          client.PolicyChecks,
+	}, nil
+}
+
+// OnRunURL is called as soon as the Run's ID (and therefore its URL) is
+// known, so the caller can update the commit status without waiting for
+// the run to finish.
+type OnRunURL func(run Run)
+
+// WorkspaceTerraformVersion returns the Terraform version cfg.Workspace is
+// configured to use in TFC/TFE, so callers can reconcile it against the
+// version Atlantis would otherwise select before kicking off a run.
+func (r *Runner) WorkspaceTerraformVersion(ctx context.Context, cfg Config) (string, error) {
+	ws, err := r.Workspaces.Read(ctx, cfg.Organization, cfg.Workspace)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading workspace %s/%s", cfg.Organization, cfg.Workspace)
+	}
+	return ws.TerraformVersion, nil
+}
+
+// Plan uploads path as a new configuration version to cfg.Workspace and
+// creates a speculative run from it. tfVersion, if non-empty, overrides
+// the Terraform version the workspace would otherwise use for this run
+// (set after reconciling a version mismatch). onRunURL is invoked the
+// moment the run is created, well before the plan itself has finished,
+// since we no longer need to watch the log for a "run url" marker line.
+// It blocks until the run reaches a terminal status and returns the
+// combined plan log output.
+func (r *Runner) Plan(ctx context.Context, cfg Config, path string, tfVersion string, destroy bool, onRunURL OnRunURL) (Run, error) {
+	ws, err := r.Workspaces.Read(ctx, cfg.Organization, cfg.Workspace)
+	if err != nil {
+		return Run{}, errors.Wrapf(err, "reading workspace %s/%s", cfg.Organization, cfg.Workspace)
+	}
+
+	cv, err := r.ConfigurationVersions.Create(ctx, ws.ID, gotfe.ConfigurationVersionCreateOptions{
+		AutoQueueRuns: gotfe.Bool(false),
+	})
+	if err != nil {
+		return Run{}, errors.Wrap(err, "creating configuration version")
+	}
+	if err := r.ConfigurationVersions.Upload(ctx, cv.UploadURL, path); err != nil {
+		return Run{}, errors.Wrap(err, "uploading configuration version")
+	}
+
+	runOpts := gotfe.RunCreateOptions{
+		Workspace:            ws,
+		ConfigurationVersion: cv,
+		IsDestroy:            gotfe.Bool(destroy),
+		Speculative:          gotfe.Bool(true),
+	}
+	if tfVersion != "" {
+		runOpts.TerraformVersion = gotfe.String(tfVersion)
+	}
+	run, err := r.Runs.Create(ctx, runOpts)
+	if err != nil {
+		return Run{}, errors.Wrap(err, "creating run")
+	}
+
+	result := Run{
+		ID:  run.ID,
+		URL: r.runURL(cfg, run.ID),
+	}
+	if onRunURL != nil {
+		onRunURL(result)
+	}
+
+	finalRun, err := r.waitForStatus(ctx, run.ID, gotfe.RunPlannedAndFinished, gotfe.RunPlanned, gotfe.RunErrored, gotfe.RunCanceled, gotfe.RunDiscarded)
+	if err != nil {
+		return result, err
+	}
+
+	output, err := r.readLogs(ctx, finalRun.Plan.ID, r.Plans.Logs)
+	if err != nil {
+		return result, err
+	}
+	result.Output = output
+
+	// The run reaching RunPlanned only means the plan itself finished; its
+	// cost estimate and policy checks are queued/running independently and
+	// may still be in progress. Reading their results before they reach a
+	// terminal status would see zero-value counts, which would wrongly
+	// look like "no hard-mandatory failures" and let apply through before
+	// policy has actually been evaluated. So wait for those to finish too.
+	if err := r.waitForPostPlanChecks(ctx, finalRun); err != nil {
+		return result, err
+	}
+	result.Cost = r.costEstimate(ctx, finalRun, cfg)
+	result.Policy = r.policyCheck(ctx, finalRun, cfg)
+
+	if finalRun.Status == gotfe.RunErrored || finalRun.Status == gotfe.RunCanceled || finalRun.Status == gotfe.RunDiscarded {
+		return result, errors.Errorf("run %s finished with status %s", finalRun.ID, finalRun.Status)
+	}
+	return result, nil
+}
+
+// waitForPostPlanChecks blocks until run's cost estimate (if any) and all
+// of its policy checks (if any) have reached a terminal status, so their
+// results can be safely read. Unlike the run's own status, these are
+// tracked on separate resources that are still queued or running when the
+// run itself first reaches RunPlanned.
+func (r *Runner) waitForPostPlanChecks(ctx context.Context, run *gotfe.Run) error {
+	if run.CostEstimate != nil {
+		if err := r.waitForCostEstimateStatus(ctx, run.CostEstimate.ID); err != nil {
+			return err
+		}
+	}
+	for _, ref := range run.PolicyChecks {
+		if err := r.waitForPolicyCheckStatus(ctx, ref.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// terminalCostEstimateStatuses are the CostEstimate.Status values after
+// which CostEstimates.Read's result won't change further.
+var terminalCostEstimateStatuses = map[gotfe.CostEstimateStatus]bool{
+	gotfe.CostEstimateFinished: true,
+	gotfe.CostEstimateErrored:  true,
+	gotfe.CostEstimateCanceled: true,
+}
+
+func (r *Runner) waitForCostEstimateStatus(ctx context.Context, id string) error {
+	for {
+		ce, err := r.CostEstimates.Read(ctx, id)
+		if err != nil {
+			return errors.Wrapf(err, "reading cost estimate %s", id)
+		}
+		if terminalCostEstimateStatuses[ce.Status] {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// terminalPolicyCheckStatuses are the PolicyCheck.Status values after
+// which PolicyChecks.Read's result won't change further.
+var terminalPolicyCheckStatuses = map[gotfe.PolicyCheckStatus]bool{
+	gotfe.PolicyPasses:     true,
+	gotfe.PolicyFailed:     true,
+	gotfe.PolicySoftFailed: true,
+	gotfe.PolicyOverridden: true,
+	gotfe.PolicyErrored:    true,
+}
+
+func (r *Runner) waitForPolicyCheckStatus(ctx context.Context, id string) error {
+	for {
+		pc, err := r.PolicyChecks.Read(ctx, id)
+		if err != nil {
+			return errors.Wrapf(err, "reading policy check %s", id)
+		}
+		if terminalPolicyCheckStatuses[pc.Status] {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// costEstimate fetches run's cost estimate, if the workspace has cost
+// estimation enabled. It's best-effort: any error is swallowed and nil is
+// returned, since a missing cost estimate shouldn't fail the plan.
+func (r *Runner) costEstimate(ctx context.Context, run *gotfe.Run, cfg Config) *CostEstimate {
+	if run.CostEstimate == nil {
+		return nil
+	}
+	ce, err := r.CostEstimates.Read(ctx, run.CostEstimate.ID)
+	if err != nil {
+		return nil
+	}
+	return &CostEstimate{
+		ProposedMonthlyCost: ce.ProposedMonthlyCost,
+		DeltaMonthlyCost:    ce.DeltaMonthlyCost,
+		URL:                 fmt.Sprintf("%s#cost-estimate", r.runURL(cfg, run.ID)),
+	}
+}
+
+// policyCheck fetches and summarizes run's Sentinel/OPA policy check
+// results, if the workspace has a policy set attached, and returns nil if
+// the run has no policy checks. It's best-effort: a policy check that
+// can't be read is skipped, and the summary covers only the checks that
+// could be read.
+func (r *Runner) policyCheck(ctx context.Context, run *gotfe.Run, cfg Config) *PolicyCheck {
+	if len(run.PolicyChecks) == 0 {
+		return nil
+	}
+
+	summary := &PolicyCheck{URL: fmt.Sprintf("%s#policy-check", r.runURL(cfg, run.ID))}
+	for _, ref := range run.PolicyChecks {
+		pc, err := r.PolicyChecks.Read(ctx, ref.ID)
+		if err != nil {
+			continue
+		}
+		summary.Status = string(pc.Status)
+		if pc.Result == nil {
+			continue
+		}
+		summary.Passed += pc.Result.Passed
+		summary.SoftFailed += pc.Result.SoftFailed
+		summary.Failed += pc.Result.HardFailed + pc.Result.AdvisoryFailed
+		if pc.Result.HardFailed > 0 {
+			summary.HardFailed = true
+		}
+	}
+	return summary
+}
+
+// Apply applies the run created by a previous call to Plan. runID is the
+// Run.ID that was stored in the planfile at plan time.
+func (r *Runner) Apply(ctx context.Context, runID string) (Run, error) {
+	if err := r.Runs.Apply(ctx, runID, gotfe.RunApplyOptions{}); err != nil {
+		return Run{}, errors.Wrapf(err, "applying run %s", runID)
+	}
+
+	finalRun, err := r.waitForStatus(ctx, runID, gotfe.RunApplied, gotfe.RunErrored, gotfe.RunCanceled)
+	result := Run{ID: runID}
+	if err != nil {
+		return result, err
+	}
+
+	output, err := r.readLogs(ctx, finalRun.Apply.ID, r.Applies.Logs)
+	if err != nil {
+		return result, err
+	}
+	result.Output = output
+
+	if finalRun.Status == gotfe.RunErrored || finalRun.Status == gotfe.RunCanceled {
+		return result, errors.Errorf("run %s apply finished with status %s", runID, finalRun.Status)
+	}
+	return result, nil
+}
+
+// PolicyHardFailed reports whether runID currently has an un-overridden
+// hard-mandatory policy check failure. It's checked live at apply time,
+// rather than trusting the plan-time snapshot stored in the planfile,
+// since an intervening `atlantis policy_override` comment may have
+// cleared it since the plan ran.
+func (r *Runner) PolicyHardFailed(ctx context.Context, runID string) (bool, error) {
+	run, err := r.Runs.Read(ctx, runID)
+	if err != nil {
+		return false, errors.Wrapf(err, "reading run %s", runID)
+	}
+	for _, ref := range run.PolicyChecks {
+		pc, err := r.PolicyChecks.Read(ctx, ref.ID)
+		if err != nil {
+			return false, errors.Wrapf(err, "reading policy check %s", ref.ID)
+		}
+		if pc.Status == gotfe.PolicyFailed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// OverridePolicy overrides every hard-mandatory policy check failure on
+// runID, in response to an explicit `atlantis policy_override` comment.
+// It doesn't re-run the plan or apply; TFC/TFE simply stops treating the
+// run as blocked from this point on.
+func (r *Runner) OverridePolicy(ctx context.Context, runID string) error {
+	run, err := r.Runs.Read(ctx, runID)
+	if err != nil {
+		return errors.Wrapf(err, "reading run %s", runID)
+	}
+	for _, ref := range run.PolicyChecks {
+		pc, err := r.PolicyChecks.Read(ctx, ref.ID)
+		if err != nil {
+			return errors.Wrapf(err, "reading policy check %s", ref.ID)
+		}
+		if pc.Status != gotfe.PolicyFailed {
+			continue
+		}
+		if _, err := r.PolicyChecks.Override(ctx, ref.ID); err != nil {
+			return errors.Wrapf(err, "overriding policy check %s", ref.ID)
+		}
+	}
+	return nil
+}
+
+// Cancel aborts runID if it hasn't reached a terminal status yet: Discard
+// if it's still queued and hasn't started planning/applying, otherwise
+// Cancel. It's used when a PR is closed, force-pushed, or superseded by a
+// new plan before the run finishes.
+func (r *Runner) Cancel(ctx context.Context, runID string) error {
+	run, err := r.Runs.Read(ctx, runID)
+	if err != nil {
+		return errors.Wrapf(err, "reading run %s", runID)
+	}
+
+	switch run.Status {
+	case gotfe.RunPending:
+		return errors.Wrap(r.Runs.Discard(ctx, runID, gotfe.RunDiscardOptions{}), "discarding run")
+	case gotfe.RunApplied, gotfe.RunErrored, gotfe.RunCanceled, gotfe.RunDiscarded, gotfe.RunPlannedAndFinished:
+		return nil
+	default:
+		return errors.Wrap(r.Runs.Cancel(ctx, runID, gotfe.RunCancelOptions{}), "canceling run")
+	}
+}
+
+// ForceCancel force-cancels runID. TFC/TFE requires a short grace period
+// after a normal Cancel before it will accept a ForceCancel, so callers
+// should only reach for this if Cancel didn't take effect.
+func (r *Runner) ForceCancel(ctx context.Context, runID string) error {
+	return errors.Wrap(r.Runs.ForceCancel(ctx, runID, gotfe.RunForceCancelOptions{}), "force-canceling run")
+}
+
+// waitForStatus polls Runs.Read until the run reaches one of the given
+// terminal statuses.
+func (r *Runner) waitForStatus(ctx context.Context, runID string, terminal ...gotfe.RunStatus) (*gotfe.Run, error) {
+	for {
+		run, err := r.Runs.Read(ctx, runID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading run %s", runID)
+		}
+		for _, s := range terminal {
+			if run.Status == s {
+				return run, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return run, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func (r *Runner) readLogs(ctx context.Context, id string, logs func(context.Context, string) (io.Reader, error)) (string, error) {
+	reader, err := logs(ctx, id)
+	if err != nil {
+		return "", errors.Wrap(err, "reading logs")
+	}
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return "", errors.Wrap(err, "reading logs")
+	}
+	return string(b), nil
+}
+
+// runURL builds a link to the run in the TFC/TFE UI.
+func (r *Runner) runURL(cfg Config, runID string) string {
+	return fmt.Sprintf("https://%s/app/%s/workspaces/%s/runs/%s", cfg.Hostname, cfg.Organization, cfg.Workspace, runID)
+}
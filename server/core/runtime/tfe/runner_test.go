@@ -0,0 +1,266 @@
+package tfe
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	gotfe "github.com/hashicorp/go-tfe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWorkspaces is a minimal workspacesClient fake.
+type fakeWorkspaces struct {
+	ws *gotfe.Workspace
+}
+
+func (f *fakeWorkspaces) Read(_ context.Context, _, _ string) (*gotfe.Workspace, error) {
+	return f.ws, nil
+}
+
+// fakeConfigurationVersions is a minimal configurationVersionsClient fake.
+type fakeConfigurationVersions struct {
+	cv *gotfe.ConfigurationVersion
+}
+
+func (f *fakeConfigurationVersions) Create(_ context.Context, _ string, _ gotfe.ConfigurationVersionCreateOptions) (*gotfe.ConfigurationVersion, error) {
+	return f.cv, nil
+}
+
+func (f *fakeConfigurationVersions) Upload(_ context.Context, _ string, _ string) error {
+	return nil
+}
+
+// fakeRuns is a minimal runsClient fake. Each call records what it was
+// invoked with so tests can assert on it.
+type fakeRuns struct {
+	createRun  *gotfe.Run
+	readRun    *gotfe.Run
+	applyErr   error
+	cancelErr  error
+	discardErr error
+
+	applied   bool
+	canceled  bool
+	forced    bool
+	discarded bool
+}
+
+func (f *fakeRuns) Create(_ context.Context, _ gotfe.RunCreateOptions) (*gotfe.Run, error) {
+	return f.createRun, nil
+}
+
+func (f *fakeRuns) Read(_ context.Context, _ string) (*gotfe.Run, error) {
+	return f.readRun, nil
+}
+
+func (f *fakeRuns) Apply(_ context.Context, _ string, _ gotfe.RunApplyOptions) error {
+	f.applied = true
+	return f.applyErr
+}
+
+func (f *fakeRuns) Cancel(_ context.Context, _ string, _ gotfe.RunCancelOptions) error {
+	f.canceled = true
+	return f.cancelErr
+}
+
+func (f *fakeRuns) ForceCancel(_ context.Context, _ string, _ gotfe.RunForceCancelOptions) error {
+	f.forced = true
+	return nil
+}
+
+func (f *fakeRuns) Discard(_ context.Context, _ string, _ gotfe.RunDiscardOptions) error {
+	f.discarded = true
+	return f.discardErr
+}
+
+// fakeLogs is a minimal logsClient fake shared by Plans and Applies.
+type fakeLogs struct {
+	output string
+}
+
+func (f *fakeLogs) Logs(_ context.Context, _ string) (io.Reader, error) {
+	return strings.NewReader(f.output), nil
+}
+
+// fakeCostEstimates is a minimal costEstimatesClient fake.
+type fakeCostEstimates struct {
+	ce *gotfe.CostEstimate
+}
+
+func (f *fakeCostEstimates) Read(_ context.Context, _ string) (*gotfe.CostEstimate, error) {
+	return f.ce, nil
+}
+
+// fakePolicyChecks is a minimal policyChecksClient fake.
+type fakePolicyChecks struct {
+	byID map[string]*gotfe.PolicyCheck
+
+	overridden []string
+}
+
+func (f *fakePolicyChecks) Read(_ context.Context, id string) (*gotfe.PolicyCheck, error) {
+	return f.byID[id], nil
+}
+
+func (f *fakePolicyChecks) Override(_ context.Context, id string) (*gotfe.PolicyCheck, error) {
+	f.overridden = append(f.overridden, id)
+	pc := f.byID[id]
+	pc.Status = gotfe.PolicyOverridden
+	return pc, nil
+}
+
+func TestRunURL(t *testing.T) {
+	r := &Runner{}
+	cfg := Config{
+		Hostname:     "app.terraform.io",
+		Organization: "my-org",
+		Workspace:    "my-workspace",
+	}
+	exp := "https://app.terraform.io/app/my-org/workspaces/my-workspace/runs/run-CZcmD7eagjhyX0vN"
+	assert.Equal(t, exp, r.runURL(cfg, "run-CZcmD7eagjhyX0vN"))
+}
+
+func TestTerminalCostEstimateStatuses(t *testing.T) {
+	terminal := []gotfe.CostEstimateStatus{gotfe.CostEstimateFinished, gotfe.CostEstimateErrored, gotfe.CostEstimateCanceled}
+	for _, s := range terminal {
+		assert.True(t, terminalCostEstimateStatuses[s], "expected %s to be terminal", s)
+	}
+	assert.False(t, terminalCostEstimateStatuses[gotfe.CostEstimatePending])
+}
+
+func TestTerminalPolicyCheckStatuses(t *testing.T) {
+	terminal := []gotfe.PolicyCheckStatus{gotfe.PolicyPasses, gotfe.PolicyFailed, gotfe.PolicySoftFailed, gotfe.PolicyOverridden, gotfe.PolicyErrored}
+	for _, s := range terminal {
+		assert.True(t, terminalPolicyCheckStatuses[s], "expected %s to be terminal", s)
+	}
+	assert.False(t, terminalPolicyCheckStatuses[gotfe.PolicyQueued])
+}
+
+func TestRunner_Plan(t *testing.T) {
+	runs := &fakeRuns{
+		createRun: &gotfe.Run{ID: "run-123", Status: gotfe.RunPlanned, Plan: &gotfe.Plan{ID: "plan-123"}},
+		readRun:   &gotfe.Run{ID: "run-123", Status: gotfe.RunPlanned, Plan: &gotfe.Plan{ID: "plan-123"}},
+	}
+	r := &Runner{
+		Workspaces:            &fakeWorkspaces{ws: &gotfe.Workspace{ID: "ws-123"}},
+		ConfigurationVersions: &fakeConfigurationVersions{cv: &gotfe.ConfigurationVersion{ID: "cv-123", UploadURL: "https://upload"}},
+		Runs:                  runs,
+		Plans:                 &fakeLogs{output: "plan output"},
+	}
+
+	var gotURL string
+	run, err := r.Plan(context.Background(), Config{Hostname: "app.terraform.io", Organization: "my-org", Workspace: "my-workspace"}, "/tmp", "1.5.0", false, func(run Run) {
+		gotURL = run.URL
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "run-123", run.ID)
+	assert.Equal(t, "plan output", run.Output)
+	assert.Nil(t, run.Cost)
+	assert.Nil(t, run.Policy)
+	assert.Equal(t, run.URL, gotURL, "onRunURL should have been called with the run URL before Plan returned")
+}
+
+func TestRunner_Plan_Errored(t *testing.T) {
+	runs := &fakeRuns{
+		createRun: &gotfe.Run{ID: "run-123", Status: gotfe.RunErrored, Plan: &gotfe.Plan{ID: "plan-123"}},
+		readRun:   &gotfe.Run{ID: "run-123", Status: gotfe.RunErrored, Plan: &gotfe.Plan{ID: "plan-123"}},
+	}
+	r := &Runner{
+		Workspaces:            &fakeWorkspaces{ws: &gotfe.Workspace{ID: "ws-123"}},
+		ConfigurationVersions: &fakeConfigurationVersions{cv: &gotfe.ConfigurationVersion{ID: "cv-123", UploadURL: "https://upload"}},
+		Runs:                  runs,
+		Plans:                 &fakeLogs{output: "plan errored"},
+	}
+
+	_, err := r.Plan(context.Background(), Config{}, "/tmp", "", false, nil)
+	require.Error(t, err)
+}
+
+func TestRunner_Apply(t *testing.T) {
+	runs := &fakeRuns{
+		readRun: &gotfe.Run{ID: "run-123", Status: gotfe.RunApplied, Apply: &gotfe.Apply{ID: "apply-123"}},
+	}
+	r := &Runner{Runs: runs, Applies: &fakeLogs{output: "apply output"}}
+
+	run, err := r.Apply(context.Background(), "run-123")
+	require.NoError(t, err)
+	assert.True(t, runs.applied)
+	assert.Equal(t, "apply output", run.Output)
+}
+
+func TestRunner_Apply_Errored(t *testing.T) {
+	runs := &fakeRuns{
+		readRun: &gotfe.Run{ID: "run-123", Status: gotfe.RunErrored, Apply: &gotfe.Apply{ID: "apply-123"}},
+	}
+	r := &Runner{Runs: runs, Applies: &fakeLogs{output: ""}}
+
+	_, err := r.Apply(context.Background(), "run-123")
+	assert.Error(t, err)
+}
+
+func TestRunner_Cancel(t *testing.T) {
+	cases := []struct {
+		description  string
+		status       gotfe.RunStatus
+		expDiscarded bool
+		expCanceled  bool
+	}{
+		{description: "pending run is discarded", status: gotfe.RunPending, expDiscarded: true},
+		{description: "running run is canceled", status: gotfe.RunPlanning, expCanceled: true},
+		{description: "already-terminal run is left alone", status: gotfe.RunApplied},
+	}
+
+	for _, c := range cases {
+		t.Run(c.description, func(t *testing.T) {
+			runs := &fakeRuns{readRun: &gotfe.Run{ID: "run-123", Status: c.status}}
+			r := &Runner{Runs: runs}
+
+			require.NoError(t, r.Cancel(context.Background(), "run-123"))
+			assert.Equal(t, c.expDiscarded, runs.discarded)
+			assert.Equal(t, c.expCanceled, runs.canceled)
+		})
+	}
+}
+
+func TestRunner_PolicyHardFailed(t *testing.T) {
+	cases := []struct {
+		description string
+		status      gotfe.PolicyCheckStatus
+		exp         bool
+	}{
+		{description: "hard failure", status: gotfe.PolicyFailed, exp: true},
+		{description: "passed", status: gotfe.PolicyPasses, exp: false},
+		{description: "already overridden", status: gotfe.PolicyOverridden, exp: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.description, func(t *testing.T) {
+			runs := &fakeRuns{readRun: &gotfe.Run{ID: "run-123", PolicyChecks: []*gotfe.PolicyCheck{{ID: "pc-1"}}}}
+			policyChecks := &fakePolicyChecks{byID: map[string]*gotfe.PolicyCheck{"pc-1": {ID: "pc-1", Status: c.status}}}
+			r := &Runner{Runs: runs, PolicyChecks: policyChecks}
+
+			hardFailed, err := r.PolicyHardFailed(context.Background(), "run-123")
+			require.NoError(t, err)
+			assert.Equal(t, c.exp, hardFailed)
+		})
+	}
+}
+
+func TestRunner_OverridePolicy(t *testing.T) {
+	runs := &fakeRuns{readRun: &gotfe.Run{ID: "run-123", PolicyChecks: []*gotfe.PolicyCheck{{ID: "pc-failed"}, {ID: "pc-passed"}}}}
+	policyChecks := &fakePolicyChecks{byID: map[string]*gotfe.PolicyCheck{
+		"pc-failed": {ID: "pc-failed", Status: gotfe.PolicyFailed},
+		"pc-passed": {ID: "pc-passed", Status: gotfe.PolicyPasses},
+	}}
+	r := &Runner{Runs: runs, PolicyChecks: policyChecks}
+
+	require.NoError(t, r.OverridePolicy(context.Background(), "run-123"))
+	assert.Equal(t, []string{"pc-failed"}, policyChecks.overridden, "only the hard-failed check should be overridden")
+
+	hardFailed, err := r.PolicyHardFailed(context.Background(), "run-123")
+	require.NoError(t, err)
+	assert.False(t, hardFailed, "PolicyHardFailed should no longer see a failure after overriding")
+}
@@ -0,0 +1,27 @@
+package command
+
+// Name is the name of a command that can be run on a pull request via a
+// VCS comment, e.g. "atlantis plan".
+type Name int
+
+const (
+	Plan Name = iota
+	Apply
+	// PolicyOverride is issued as "atlantis policy_override" to override a
+	// hard-mandatory Sentinel/OPA policy failure on a TFE-backed run,
+	// rather than as a flag on "atlantis apply".
+	PolicyOverride
+)
+
+func (c Name) String() string {
+	switch c {
+	case Plan:
+		return "plan"
+	case Apply:
+		return "apply"
+	case PolicyOverride:
+		return "policy_override"
+	default:
+		return "unknown"
+	}
+}
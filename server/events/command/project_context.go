@@ -0,0 +1,50 @@
+package command
+
+import (
+	"context"
+
+	version "github.com/hashicorp/go-version"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/runatlantis/atlantis/server/core/runtime/tfe"
+	"github.com/runatlantis/atlantis/server/events/models"
+	"github.com/runatlantis/atlantis/server/logging"
+)
+
+// ProjectContext holds everything a step runner needs to plan/apply/.... a
+// single project within a single pull request.
+type ProjectContext struct {
+	Log logging.SimpleLogging
+	// BaseRepo is the repo the pull request is against.
+	BaseRepo models.Repo
+	Pull     models.PullRequest
+	User     models.User
+	// ProjectName is the name of the project as configured in
+	// atlantis.yaml, if one was given. May be empty.
+	ProjectName string
+	Workspace   string
+	// EscapedCommentArgs are the extra arguments the user passed on their
+	// `atlantis plan`/`atlantis apply`/... comment, e.g. ["-destroy"].
+	EscapedCommentArgs []string
+	// TerraformVersion is the Terraform version configured for this
+	// project, if one was set in atlantis.yaml. Nil means use the
+	// server-wide default.
+	TerraformVersion *version.Version
+	// PlanJSON is the parsed `terraform show -json` output for this
+	// project's plan, set by the plan step once it's run so that
+	// downstream consumers (the comment renderer, policy check step,
+	// custom workflow steps) don't need to re-parse it. Nil until the
+	// plan step sets it.
+	PlanJSON *tfjson.Plan
+	// TFEConfig is set, via atlantis.yaml, when this project should run
+	// natively against a TFC/TFE workspace through go-tfe rather than a
+	// local `terraform` binary. Nil for local execution.
+	TFEConfig *tfe.Config
+	// CommandContext is canceled when the event that triggered this
+	// command (the command itself, the pull request, or a superseding
+	// command) is no longer relevant, e.g. the PR closes, is
+	// force-pushed, or a newer `atlantis plan` supersedes this one. TFE
+	// runs watch it and stop waiting on the underlying TFC/TFE run once
+	// it's canceled; canceling that run itself is done separately, through
+	// the plan step's CancelRun.
+	CommandContext context.Context
+}
@@ -0,0 +1,44 @@
+// Package models holds the VCS-agnostic data types (repos, pull requests,
+// commit statuses) shared across the events and runtime packages.
+package models
+
+// Repo is a VCS repository.
+type Repo struct {
+	// FullName is e.g. "runatlantis/atlantis".
+	FullName string
+	Owner    string
+	Name     string
+}
+
+// PullRequest is a VCS pull/merge request.
+type PullRequest struct {
+	Num int
+}
+
+// User is a VCS user.
+type User struct {
+	Username string
+}
+
+// CommitStatus is the state of a commit status/check posted to the VCS
+// host, e.g. via the GitHub Checks API.
+type CommitStatus int
+
+const (
+	PendingCommitStatus CommitStatus = iota
+	SuccessCommitStatus
+	FailedCommitStatus
+)
+
+func (s CommitStatus) String() string {
+	switch s {
+	case PendingCommitStatus:
+		return "pending"
+	case SuccessCommitStatus:
+		return "success"
+	case FailedCommitStatus:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,14 @@
+// Package logging provides the logging interface used throughout Atlantis
+// so that callers don't need to depend on a specific logging library.
+package logging
+
+// SimpleLogging is implemented by the per-request/per-project loggers passed
+// around as command.ProjectContext.Log. Each method takes a printf-style
+// format string so call sites can log structured detail without needing to
+// pre-format it themselves.
+type SimpleLogging interface {
+	Debug(format string, a ...interface{})
+	Info(format string, a ...interface{})
+	Warn(format string, a ...interface{})
+	Err(format string, a ...interface{})
+}